@@ -92,71 +92,137 @@
 // ↣ file generic.go is created in the package
 // (e.g. `stack.go`)
 //
+// Multi-parameter generics
+//
+// A generic may declare more than one type variable, e.g. `genK`/`genV` for
+// a `Map[K,V]`-like container. The `-type` flag then takes a comma-separated
+// list of `Name=type` pairs matching the declared variables
+//
+//   //go:generate golem -type K=string,V=int -generic github.com/fogfish/golem/map/map.go
+//
+// `AnyT` is substituted with the concatenation of the parametrized types
+// (e.g. `AnyT` -> `StringInt`), unless `-name` supplies an explicit override.
+//
+// Qualified types
+//
+// A parametrized type may be qualified by a package, e.g. `time.Duration` or
+// `*pkg.Foo`. Golem resolves the substitution through `go/ast` rather than a
+// textual replace, so it rewrites `map[genT]*AnyT` correctly and does not
+// corrupt `genT`/`AnyT` occurrences inside string literals, comments, struct
+// tags, or compound identifiers like `AnyTransform`. When the concrete type
+// pulls in a new package, pair it with `-import`
+//
+//   //go:generate golem -type T=time.Duration -import time -generic github.com/fogfish/golem/stack/stack.go
+//
+// Batch generation
+//
+// A library that instantiates many variants of many generics (a stack, a
+// queue, a heap, ...) can skip one `//go:generate` line per variant and
+// describe them all in a `golem.json` manifest in the package directory
+// instead
+//
+//   {
+//     "generics": [
+//       {"source": "stack/stack.go", "instances": [{"type": "T=int"}, {"type": "T=string"}]},
+//       {"inputDirs": ["collections/*.go"], "instances": [{"type": "T=int", "lib": true}]}
+//     ]
+//   }
+//
+// Running `golem` with no `-type`/`-generic` (or with `-manifest path`)
+// reads the manifest and generates every instance in one pass, sharing each
+// generic source's bytes across its instantiations and writing the results
+// concurrently. See package `github.com/fogfish/golem/pkg/gen` for the
+// manifest schema.
+//
+// Native generics
+//
+// The `genT`/`AnyT` convention predates Go 1.18 type parameters. `-emit
+// generics` targets real generics instead of a specialized copy: it
+// synthesizes a `<generic>_generic.go` file that migrates the upstream
+// declaration to `[T any]` parameters (e.g. `AnyT` -> `AnyT[T any]`), and a
+// thin alias wrapper in the consuming package, e.g. `type Int = AnyT[int]`.
+// The default remains specialized emission, so existing call sites keep
+// working unchanged.
+//
+//   //go:generate golem -emit generics -type T=int -generic github.com/fogfish/golem/stack/stack.go
+//
+// A generic source already committed to the repository can be migrated to
+// native type parameters in place with the `migrate` subcommand
+//
+//   golem migrate -generic stack/stack.go
+//
+// Companion tests and benchmarks
+//
+// When a generic source has a sibling `*_test.go` file (e.g. `stream_test.go`
+// next to `stream.go`), golem instantiates it through the same pipeline,
+// producing e.g. `int_test.go`. Passing `-bench` additionally synthesizes a
+// benchmark stub per method declared on the generic type, so
+// `BenchmarkStackInt_Push`/`_Pop` exist for every instantiation without
+// being hand-written.
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"go/build"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
+
+	"github.com/fogfish/golem/pkg/gen"
 )
 
 //
 type opts struct {
-	kind    *string
-	generic *string
-	lib     *bool
+	kind     *string
+	name     *string
+	imports  *string
+	generic  *string
+	lib      *bool
+	manifest *string
+	emit     *string
+	bench    *bool
 }
 
 func parseOpts() opts {
 	spec := opts{
-		flag.String("type", "", "defines a parametrization to generic type."),
+		flag.String("type", "", "defines a parametrization to generic type, e.g. T=string or K=string,V=int."),
+		flag.String("name", "", "overrides the name substituted for AnyT (defaults to the parametrized types)."),
+		flag.String("import", "", "imports required by a qualified type, e.g. time or alias=path/to/pkg."),
 		flag.String("generic", "", "locates a path to generic type."),
 		flag.Bool("lib", false, "use library declaration schema."),
+		flag.String("manifest", "", "locates a golem.json manifest for batch generation."),
+		flag.String("emit", "specialized", "emission mode: specialized (default) or generics."),
+		flag.Bool("bench", false, "also synthesize a benchmark stub per method for this instantiation."),
 	}
 	flag.Parse()
 	return spec
 }
 
-//
-func declareType(file []byte, kind string) []byte {
-	a := bytes.Replace(file,
-		[]byte("type genT interface{}"),
-		[]byte(fmt.Sprintf("type gen%s %s", strings.Title(kind), kind)),
-		1,
-	)
-	b := bytes.ReplaceAll(a,
-		[]byte("genT"),
-		[]byte(fmt.Sprintf("gen%s", strings.Title(kind))),
-	)
-	return b
-}
-
-//
-func referenceType(file []byte, kind string) []byte {
-	return bytes.ReplaceAll(file,
-		[]byte("AnyT"),
-		[]byte(kind),
-	)
-}
-
-//
-func repackage(file []byte, pkg string) []byte {
-	re := regexp.MustCompile(`package (.*)\n`)
-	return re.ReplaceAll(file, []byte("package "+pkg+"\n"))
+// defaultManifest looks for golem.json in the working directory, returning
+// "" if it does not exist.
+func defaultManifest() string {
+	if _, err := os.Stat("golem.json"); err == nil {
+		return "golem.json"
+	}
+	return ""
 }
 
-//
 func main() {
 	var err error
 	log.SetFlags(0)
 	log.SetPrefix("==> golem: ")
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
 	opt := parseOpts()
 
 	pkg, err := build.Default.ImportDir(".", 0)
@@ -164,32 +230,192 @@ func main() {
 		log.Fatal(err)
 	}
 
+	manifest := *opt.manifest
+	if manifest == "" && *opt.generic == "" {
+		manifest = defaultManifest()
+	}
+	if manifest != "" {
+		runManifest(pkg, manifest)
+		return
+	}
+
 	source := filepath.Join(build.Default.GOPATH, "src", *opt.generic)
 	generic := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
 
+	input, err := ioutil.ReadFile(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	params, err := gen.ParseTypeParams(*opt.kind)
+	if err != nil {
+		log.Fatal(err)
+	}
+	typename := gen.TypeName(*opt.name, params)
+	inst := gen.Instance{Type: *opt.kind, Name: *opt.name}
+
+	if *opt.emit == "generics" {
+		runEmitGenerics(pkg, *opt.generic, inst, source, input, params, typename, generic)
+		return
+	}
+
+	imports, err := gen.ParseImports(*opt.imports)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	filename := fmt.Sprintf("%s.go", generic)
-	typename := strings.Title(generic)
 	if *opt.lib {
-		filename = fmt.Sprintf("%s.go", *opt.kind)
-		typename = strings.Title(*opt.kind)
+		filename = fmt.Sprintf("%s.go", strings.ToLower(typename))
 	}
 
-	input, err := ioutil.ReadFile(source)
+	generated, err := gen.Instantiate(source, input, params, typename, pkg.Name, imports)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	a := declareType(input, *opt.kind)
-	b := referenceType(a, typename)
-	c := repackage(b, pkg.Name)
+	header := gen.Header(*opt.generic, inst, "")
+	ioutil.WriteFile(filepath.Join(pkg.PkgRoot, filename), append(header, generated...), 0777)
+	log.Printf("%s.%s", generic, typename)
 
-	output := bytes.NewBuffer([]byte{})
-	output.Write([]byte("// Code generated by `golem` package\n"))
-	output.Write([]byte(fmt.Sprintf("// Source: %s\n", *opt.generic)))
-	output.Write([]byte(fmt.Sprintf("// Time: %s\n\n", time.Now().UTC())))
+	runCompanions(pkg, *opt.generic, inst, source, input, params, typename, generic, filename, *opt.bench)
+}
 
-	output.Write(c)
+// runCompanions instantiates a generic's sibling `*_test.go` file, if one
+// exists, and synthesizes benchmark stubs when bench is set.
+func runCompanions(pkg *build.Package, genericImportPath string, inst gen.Instance, source string, input []byte, params []gen.TypeParam, typename, generic, filename string, bench bool) {
+	testSource := gen.TestSource(source)
+	if testInput, err := ioutil.ReadFile(testSource); err == nil {
+		generatedTest, err := gen.InstantiateReferences(testSource, testInput, params, typename, pkg.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		testFilename := gen.TestSource(filename)
+		header := gen.Header(genericImportPath, inst, "")
+		ioutil.WriteFile(filepath.Join(pkg.PkgRoot, testFilename), append(header, generatedTest...), 0777)
+		log.Printf("%s.%s_test", generic, typename)
+	}
 
-	ioutil.WriteFile(filepath.Join(pkg.PkgRoot, filename), output.Bytes(), 0777)
-	log.Printf("%s.%s", generic, typename)
+	if !bench {
+		return
+	}
+
+	fset := token.NewFileSet()
+	astFile, err := parser.ParseFile(fset, source, input, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+	methods := gen.DeclaredMethods(astFile, "AnyT")
+	stubs, err := gen.BenchmarkStubs(pkg.Name, generic, typename, methods)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stubs == nil {
+		return
+	}
+	benchFilename := fmt.Sprintf("%s_bench_test.go", strings.ToLower(typename))
+	header := gen.Header(genericImportPath, inst, "")
+	ioutil.WriteFile(filepath.Join(pkg.PkgRoot, benchFilename), append(header, stubs...), 0777)
+	log.Printf("%s.%s_bench_test", generic, typename)
+}
+
+// runEmitGenerics implements `-emit generics`: it migrates the generic
+// source to native type parameters into `<generic>_generic.go`, and writes
+// a thin `type <typename> = <genericName>[...]` alias wrapper alongside it.
+func runEmitGenerics(pkg *build.Package, genericImportPath string, inst gen.Instance, source string, input []byte, params []gen.TypeParam, typename, generic string) {
+	genericSrc, aliasSrc, genericName, err := gen.EmitGenerics(source, input, params, typename, pkg.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	header := gen.Header(genericImportPath, inst, "")
+	genericFile := filepath.Join(pkg.PkgRoot, fmt.Sprintf("%s_generic.go", generic))
+	if err := ioutil.WriteFile(genericFile, append(header, genericSrc...), 0777); err != nil {
+		log.Fatal(err)
+	}
+
+	aliasFile := filepath.Join(pkg.PkgRoot, fmt.Sprintf("%s.go", strings.ToLower(typename)))
+	if err := ioutil.WriteFile(aliasFile, append(header, aliasSrc...), 0777); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s.%s (native: %s[%s])", generic, typename, genericName, joinKinds(params))
+}
+
+// joinKinds renders the parametrized types for the -emit generics log line,
+// e.g. "int" or "string, int".
+func joinKinds(params []gen.TypeParam) string {
+	kinds := make([]string, len(params))
+	for i, p := range params {
+		kinds[i] = p.Kind
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// runMigrate implements the `golem migrate` subcommand: it rewrites a
+// generic source file in place from the legacy `genT interface{}`/`AnyT`
+// convention to native Go 1.18+ type parameters.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	generic := fs.String("generic", "", "path to the generic source file to migrate in place.")
+	fs.Parse(args)
+
+	if *generic == "" {
+		log.Fatal("-generic is required")
+	}
+
+	input, err := ioutil.ReadFile(*generic)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, *generic, input, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := gen.Migrate(file); err != nil {
+		log.Fatal(err)
+	}
+
+	output, err := gen.Print(fset, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(*generic, output, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("migrated %s to native type parameters", *generic)
+}
+
+// runManifest drives batch generation for every instance described by the
+// manifest at path, writing the results into pkg's directory.
+func runManifest(pkg *build.Package, path string) {
+	m, err := gen.LoadManifest(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	builder := &gen.Builder{BaseDir: pkg.PkgRoot, Package: pkg.Name}
+	outputs, err := builder.Build(m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := gen.WriteAll(outputs); err != nil {
+		log.Fatal(err)
+	}
+
+	if m.Clean {
+		removed, err := builder.Clean(m, pkg.PkgRoot)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, path := range removed {
+			log.Printf("removed %s", path)
+		}
+	}
+
+	log.Printf("generated %d file(s) from %s at %s", len(outputs), path, time.Now().UTC())
 }
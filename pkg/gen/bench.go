@@ -0,0 +1,71 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"path/filepath"
+	"strings"
+)
+
+// TestSource returns the path of the sibling `*_test.go` file for a generic
+// source, e.g. "stream/stream.go" -> "stream/stream_test.go".
+func TestSource(source string) string {
+	return strings.TrimSuffix(source, filepath.Ext(source)) + "_test.go"
+}
+
+// DeclaredMethods returns the names of the methods declared in file with a
+// value or pointer receiver of the given type, in declaration order.
+func DeclaredMethods(file *ast.File, receiver string) []string {
+	var methods []string
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 {
+			continue
+		}
+		if receiverTypeName(fn.Recv.List[0].Type) == receiver {
+			methods = append(methods, fn.Name.Name)
+		}
+	}
+	return methods
+}
+
+func receiverTypeName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// BenchmarkStubs renders a `*_test.go` source declaring one benchmark stub
+// per method, named `Benchmark<generic><typename>_<Method>` (e.g.
+// `BenchmarkStackInt_Push`). Each stub is a TODO for the library author to
+// fill in with a representative workload for that instantiation. It returns
+// nil, nil if methods is empty (e.g. a data-only generic whose operations
+// are free functions, not methods on AnyT), since a benchmark file with no
+// stubs would only leave an unused `testing` import behind.
+func BenchmarkStubs(pkg, generic, typename string, methods []string) ([]byte, error) {
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "package %s\n\nimport \"testing\"\n\n", pkg)
+	for _, m := range methods {
+		fmt.Fprintf(&buf, "func Benchmark%s%s_%s(b *testing.B) {\n\tfor i := 0; i < b.N; i++ {\n\t\t// TODO: exercise %s.%s for this instantiation.\n\t}\n}\n\n",
+			strings.Title(generic), typename, strings.Title(m), typename, m)
+	}
+	return format.Source(buf.Bytes())
+}
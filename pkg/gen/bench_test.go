@@ -0,0 +1,82 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+package gen
+
+import (
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const stackTestSrc = `package stack
+
+import "testing"
+
+func TestAnyT_Push(t *testing.T) {
+	s := AnyT{}
+	_ = s
+}
+`
+
+// TestInstantiateReferencesDisambiguatesMultipleInstances reproduces
+// stack.Int and stack.String sharing a package: each instantiation of the
+// companion *_test.go must declare a distinctly named test function.
+func TestInstantiateReferencesDisambiguatesMultipleInstances(t *testing.T) {
+	intParams := []TypeParam{{Name: "T", Kind: "int"}}
+	intOut, err := InstantiateReferences("stack_test.go", []byte(stackTestSrc), intParams, TypeName("", intParams), "stack")
+	if err != nil {
+		t.Fatalf("InstantiateReferences(int): %v", err)
+	}
+
+	stringParams := []TypeParam{{Name: "T", Kind: "string"}}
+	stringOut, err := InstantiateReferences("stack_test.go", []byte(stackTestSrc), stringParams, TypeName("", stringParams), "stack")
+	if err != nil {
+		t.Fatalf("InstantiateReferences(string): %v", err)
+	}
+
+	if !strings.Contains(string(intOut), "func TestInt_Push(") {
+		t.Fatalf("expected TestInt_Push, got:\n%s", intOut)
+	}
+	if !strings.Contains(string(stringOut), "func TestString_Push(") {
+		t.Fatalf("expected TestString_Push, got:\n%s", stringOut)
+	}
+
+	// The two outputs would collide with `go vet`'s "redeclared in this
+	// block" if they ever named the same function in the same package.
+	fset := token.NewFileSet()
+	merged := string(intOut) + "\n" + strings.TrimPrefix(string(stringOut), "package stack\n\nimport \"testing\"\n")
+	if _, err := parser.ParseFile(fset, "merged_test.go", merged, parser.DeclarationErrors); err != nil {
+		t.Fatalf("merged output does not parse (likely a name collision): %v\n%s", err, merged)
+	}
+}
+
+func TestBenchmarkStubsEmptyMethods(t *testing.T) {
+	out, err := BenchmarkStubs("stack", "stack", "Int", nil)
+	if err != nil {
+		t.Fatalf("BenchmarkStubs: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("expected nil output for a generic with no methods, got:\n%s", out)
+	}
+}
+
+func TestBenchmarkStubs(t *testing.T) {
+	out, err := BenchmarkStubs("stack", "stack", "Int", []string{"Push"})
+	if err != nil {
+		t.Fatalf("BenchmarkStubs: %v", err)
+	}
+	if _, err := format.Source(out); err != nil {
+		t.Fatalf("stub source is not valid Go: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "func BenchmarkStackInt_Push(b *testing.B)") {
+		t.Fatalf("expected BenchmarkStackInt_Push, got:\n%s", out)
+	}
+}
@@ -0,0 +1,442 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+// Package gen is the instantiation engine behind the `golem` command. It
+// parses a generic source with `go/parser`, substitutes its declared type
+// variables and `AnyT` placeholder via `go/ast`, and prints the result back
+// through `go/printer`/`go/format`. `cmd/golem` is a thin CLI wrapper around
+// this package; it is also the engine behind manifest-driven batch
+// generation, see Manifest and Builder.
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TypeParam is a single type variable substitution, e.g. `K=string`.
+type TypeParam struct {
+	Name string
+	Kind string
+}
+
+// ParseTypeParams splits a `-type` flag value into an ordered list of
+// variable/type pairs. A bare value (no `=`) is treated as the sole
+// parameter `T`, preserving the single-type invocation.
+func ParseTypeParams(spec string) ([]TypeParam, error) {
+	params := make([]TypeParam, 0)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "=") {
+			params = append(params, TypeParam{Name: "T", Kind: part})
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		name, kind := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if name == "" || kind == "" {
+			return nil, fmt.Errorf("invalid -type entry %q, expected Name=type", part)
+		}
+		params = append(params, TypeParam{Name: name, Kind: kind})
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("-type is required, e.g. -type T=string or -type K=string,V=int")
+	}
+	return params, nil
+}
+
+// ParseImports splits a `-import` flag value into a package-name -> path
+// map, so a concrete type like `time.Duration` can pull in its package.
+// Accepts bare import paths (the name is taken from the path's last
+// element) or explicit `name=path` pairs for packages whose name differs
+// from their path.
+func ParseImports(spec string) (map[string]string, error) {
+	imports := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "=") {
+			kv := strings.SplitN(part, "=", 2)
+			name, importPath := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			if name == "" || importPath == "" {
+				return nil, fmt.Errorf("invalid -import entry %q, expected name=path", part)
+			}
+			imports[name] = importPath
+			continue
+		}
+		imports[path.Base(part)] = part
+	}
+	return imports, nil
+}
+
+// TypeName derives the identifier substituted for `AnyT`: the override if
+// given, otherwise the parametrized types concatenated in declaration order
+// (e.g. `K=string,V=int` -> `StringInt`).
+func TypeName(override string, params []TypeParam) string {
+	if override != "" {
+		return strings.Title(override)
+	}
+	name := ""
+	for _, p := range params {
+		name += identSuffix(p.Kind)
+	}
+	return name
+}
+
+// identSuffix derives an exported Go identifier fragment from a type
+// expression, e.g. "int" -> "Int", "time.Duration" -> "Duration", and
+// "*pkg.Foo" -> "Foo". A qualified or pointer-qualified kind cannot appear
+// verbatim inside a synthesized identifier (e.g. `genTTime.Duration` is not
+// valid Go), so only its trailing type name is kept.
+func identSuffix(kind string) string {
+	s := kind
+	if i := strings.LastIndexByte(s, '.'); i >= 0 {
+		s = s[i+1:]
+	}
+	s = strings.TrimLeft(s, "*[]")
+	return strings.Title(s)
+}
+
+// concreteAlias names the concrete alias substituted for `gen<Name>`. With a
+// single type parameter it keeps the original single-parameter convention,
+// `gen` + Kind (e.g. `genT` -> `genInt`), documented in cmd/golem's package
+// comment; with more than one, `<Name>` alone no longer disambiguates (e.g.
+// `K=int,V=int`), so the alias is `gen<Name>` + Kind instead (e.g. `genK` ->
+// `genKInt`).
+func concreteAlias(p TypeParam, numParams int) string {
+	if numParams == 1 {
+		return "gen" + identSuffix(p.Kind)
+	}
+	return "gen" + p.Name + identSuffix(p.Kind)
+}
+
+// DeclaredTypeVars scans the generic's parsed source for `type gen<Name>
+// interface{}` declarations and returns the variable names in order of
+// appearance.
+func DeclaredTypeVars(file *ast.File) []string {
+	var vars []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || !strings.HasPrefix(spec.Name.Name, "gen") {
+			return true
+		}
+		if _, ok := spec.Type.(*ast.InterfaceType); !ok {
+			return true
+		}
+		vars = append(vars, strings.TrimPrefix(spec.Name.Name, "gen"))
+		return true
+	})
+	return vars
+}
+
+// MatchTypeParams aligns the requested TypeParams against the generic's
+// declared type variables, erroring clearly when they disagree.
+func MatchTypeParams(declared []string, params []TypeParam) error {
+	if len(declared) != len(params) {
+		return fmt.Errorf("generic declares %d type variable(s) %v, but -type supplies %d", len(declared), declared, len(params))
+	}
+	want := make(map[string]bool, len(declared))
+	for _, d := range declared {
+		want[d] = true
+	}
+	for _, p := range params {
+		if !want[p.Name] {
+			return fmt.Errorf("generic does not declare type variable %q, has %v", p.Name, declared)
+		}
+	}
+	return nil
+}
+
+// qualifiers collects the package identifiers referenced by a parsed type
+// expression, e.g. "time" for time.Duration.
+func qualifiers(expr ast.Expr) []string {
+	var pkgs []string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				pkgs = append(pkgs, id.Name)
+			}
+		}
+		return true
+	})
+	return pkgs
+}
+
+// addImport ensures the file imports importPath, aliased to name if it
+// differs from the path's default package name. It is a no-op if the
+// package is already imported.
+func addImport(file *ast.File, name, importPath string) {
+	for _, imp := range file.Imports {
+		if strings.Trim(imp.Path.Value, `"`) == importPath {
+			return
+		}
+	}
+
+	spec := &ast.ImportSpec{
+		Path: &ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", importPath)},
+	}
+	if name != "" && name != path.Base(importPath) {
+		spec.Name = ast.NewIdent(name)
+	}
+	file.Imports = append(file.Imports, spec)
+
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			gen.Specs = append(gen.Specs, spec)
+			return
+		}
+	}
+
+	file.Decls = append([]ast.Decl{
+		&ast.GenDecl{Tok: token.IMPORT, Specs: []ast.Spec{spec}},
+	}, file.Decls...)
+}
+
+// substituteTypeSpec replaces the `interface{}` body of the type declared
+// as name with expr, reporting whether the declaration was found.
+func substituteTypeSpec(file *ast.File, name string, expr ast.Expr) bool {
+	found := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != name {
+			return true
+		}
+		if _, ok := spec.Type.(*ast.InterfaceType); !ok {
+			return true
+		}
+		spec.Type = expr
+		found = true
+		return false
+	})
+	return found
+}
+
+// renameIdents renames every identifier in the file matched by renames,
+// leaving string literals, comments, and struct tags untouched.
+func renameIdents(file *ast.File, renames map[string]string) {
+	ast.Inspect(file, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if to, ok := renames[id.Name]; ok {
+				id.Name = to
+			}
+		}
+		return true
+	})
+}
+
+// renameComments rewrites whole-word occurrences of renames' keys in every
+// comment in file, so a doc comment like `// AnyT is a generic stack of
+// genT elements.` keeps referring to the identifiers by the names
+// renameIdents gave them, instead of to names the rewritten file no longer
+// declares. Matching is word-bounded the same way renameIdents is
+// identifier-bounded, so a comment mentioning `AnyTransform` is left alone
+// by a rename of `AnyT`.
+func renameComments(file *ast.File, renames map[string]string) {
+	if len(renames) == 0 {
+		return
+	}
+	words := make([]string, 0, len(renames))
+	for from := range renames {
+		words = append(words, regexp.QuoteMeta(from))
+	}
+	sort.Strings(words)
+	re := regexp.MustCompile(`\b(` + strings.Join(words, "|") + `)\b`)
+
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			c.Text = re.ReplaceAllStringFunc(c.Text, func(m string) string {
+				return renames[m]
+			})
+		}
+	}
+}
+
+// DeclareType walks the parsed generic source and, for every type variable
+// in params, replaces its `interface{}` body with the concrete type and
+// renames the alias itself (e.g. `genT` -> `genInt`, or `genK`/`genV` ->
+// `genKInt`/`genVString` when disambiguation is needed for a multi-parameter
+// generic). Unlike a textual replace this only touches identifiers and type
+// expressions the parser resolved, so a `genT`/`AnyT` occurrence inside a
+// string literal, comment, struct tag, or compound identifier (e.g.
+// `AnyTransform`) is left alone, and a qualified concrete type (e.g.
+// `time.Duration`) substitutes correctly wherever `genT` appears, including
+// inside compound types like `map[genT]*AnyT`.
+func DeclareType(file *ast.File, params []TypeParam, imports map[string]string) error {
+	renames := make(map[string]string, len(params))
+
+	for _, p := range params {
+		generic := "gen" + p.Name
+		concrete := concreteAlias(p, len(params))
+
+		expr, err := parser.ParseExpr(p.Kind)
+		if err != nil {
+			return fmt.Errorf("invalid type %q: %w", p.Kind, err)
+		}
+		if !substituteTypeSpec(file, generic, expr) {
+			return fmt.Errorf("generic does not declare `type %s interface{}`", generic)
+		}
+		for _, q := range qualifiers(expr) {
+			if importPath, ok := imports[q]; ok {
+				addImport(file, q, importPath)
+			}
+		}
+		renames[generic] = concrete
+	}
+
+	renameIdents(file, renames)
+	renameComments(file, renames)
+	return nil
+}
+
+// ReferenceType renames every `AnyT` identifier in file to typename, along
+// with every mention of `AnyT` in its comments.
+func ReferenceType(file *ast.File, typename string) {
+	renames := map[string]string{"AnyT": typename}
+	renameIdents(file, renames)
+	renameComments(file, renames)
+}
+
+// Repackage sets file's package clause to pkg.
+func Repackage(file *ast.File, pkg string) {
+	file.Name = ast.NewIdent(pkg)
+}
+
+// Print renders file back to formatted Go source. Because substitution
+// mutates existing TypeSpec/Ident nodes in place rather than splicing byte
+// ranges, a doc comment attached to a renamed declaration (e.g. `AnyT`'s)
+// stays attached to it through printer.Fprint without a separate position
+// remap step; renameComments separately keeps the comment's own text in
+// step with the identifiers it names. format.Source then applies gofmt's
+// canonical layout; if the substitution produced invalid Go (e.g. an
+// ill-formed qualified type), the error is enriched with the offending
+// line so it fails loudly here rather than as a broken file on disk.
+func Print(fset *token.FileSet, file *ast.File) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, file); err != nil {
+		return nil, fmt.Errorf("printing generated source: %w", err)
+	}
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, formatError(buf.Bytes(), err)
+	}
+	return formatted, nil
+}
+
+// formatError enriches a go/format error with the offending source line so
+// a malformed substitution is diagnosed immediately, with line and column,
+// instead of silently producing broken Go.
+func formatError(src []byte, err error) error {
+	var first *scanner.Error
+	switch e := err.(type) {
+	case scanner.ErrorList:
+		if len(e) == 0 {
+			return fmt.Errorf("formatting generated source: %w", err)
+		}
+		first = e[0]
+	case *scanner.Error:
+		first = e
+	default:
+		return fmt.Errorf("formatting generated source: %w", err)
+	}
+
+	lines := bytes.Split(src, []byte("\n"))
+	snippet := ""
+	if first.Pos.Line-1 < len(lines) {
+		snippet = strings.TrimRight(string(lines[first.Pos.Line-1]), "\r")
+	}
+	return fmt.Errorf("formatting generated source at %s: %s\n\t%s", first.Pos, first.Msg, snippet)
+}
+
+// InstantiateReferences renames `genT`/`AnyT` references in a file that has
+// no `gen<Name>` declarations of its own, e.g. a generic's sibling
+// `*_test.go`, which only consumes `AnyT`/`genT` from its companion source
+// and never redeclares them. Unlike Instantiate it does not require or
+// validate declared type variables, since there are none to find.
+func InstantiateReferences(filename string, src []byte, params []TypeParam, typename, pkg string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	renames := make(map[string]string, len(params)+1)
+	for _, p := range params {
+		renames["gen"+p.Name] = concreteAlias(p, len(params))
+	}
+	renames["AnyT"] = typename
+
+	renameIdents(file, renames)
+	renameComments(file, renames)
+	renameTestFuncs(file, renames)
+	Repackage(file, pkg)
+	return Print(fset, file)
+}
+
+// renameTestFuncs disambiguates top-level `Test<Name>`/`Benchmark<Name>`/
+// `Example<Name>` functions for each old -> new identifier in renames, e.g.
+// `TestAnyT_Push` -> `TestInt_Push`. renameIdents only rewrites exact
+// identifier matches, so by design it leaves a compound identifier like
+// `TestAnyT_Push` alone (to avoid corrupting an unrelated name like
+// `TestAnyTransform_Foo`); left unrewritten, every instantiation of the same
+// companion `*_test.go` would declare an identically named test function.
+func renameTestFuncs(file *ast.File, renames map[string]string) {
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		for _, prefix := range []string{"Test", "Benchmark", "Example"} {
+			for old, new := range renames {
+				full := prefix + old
+				switch {
+				case fn.Name.Name == full:
+					fn.Name.Name = prefix + new
+				case strings.HasPrefix(fn.Name.Name, full+"_"):
+					fn.Name.Name = prefix + new + strings.TrimPrefix(fn.Name.Name, full)
+				}
+			}
+		}
+	}
+}
+
+// Instantiate runs the full substitution pipeline over a generic source: it
+// parses src, matches and substitutes params, renames AnyT to typename,
+// repackages to pkg, and formats the result. It is the engine shared by
+// golem's single-shot `-type`/`-generic` invocation and its manifest-driven
+// batch mode.
+func Instantiate(filename string, src []byte, params []TypeParam, typename, pkg string, imports map[string]string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if err := MatchTypeParams(DeclaredTypeVars(file), params); err != nil {
+		return nil, err
+	}
+	if err := DeclareType(file, params, imports); err != nil {
+		return nil, err
+	}
+	ReferenceType(file, typename)
+	Repackage(file, pkg)
+	return Print(fset, file)
+}
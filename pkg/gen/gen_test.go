@@ -0,0 +1,105 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+package gen
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const stackSrc = `package stack
+
+type genT interface{}
+
+// AnyT is a generic stack of genT elements.
+type AnyT struct {
+	elements []genT
+}
+
+func (s *AnyT) Push(x genT) { s.elements = append(s.elements, x) }
+`
+
+func TestInstantiate(t *testing.T) {
+	out, err := Instantiate("stack.go", []byte(stackSrc), []TypeParam{{Name: "T", Kind: "int"}}, "Int", "stack", nil)
+	if err != nil {
+		t.Fatalf("Instantiate: %v", err)
+	}
+
+	got := string(out)
+	want := `package stack
+
+type genInt int
+
+// Int is a generic stack of genInt elements.
+type Int struct {
+	elements []genInt
+}
+
+func (s *Int) Push(x genInt) { s.elements = append(s.elements, x) }
+`
+	if got != want {
+		t.Fatalf("Instantiate output mismatch:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "int.go", out, 0); err != nil {
+		t.Fatalf("generated source does not parse: %v", err)
+	}
+}
+
+func TestInstantiateQualifiedType(t *testing.T) {
+	params := []TypeParam{{Name: "T", Kind: "time.Duration"}}
+	out, err := Instantiate("stack.go", []byte(stackSrc), params, TypeName("", params), "stack",
+		map[string]string{"time": "time"})
+	if err != nil {
+		t.Fatalf("Instantiate: %v", err)
+	}
+
+	got := string(out)
+	if !strings.Contains(got, `"time"`) {
+		t.Fatalf("expected generated source to import \"time\", got:\n%s", got)
+	}
+	if !strings.Contains(got, "type genDuration time.Duration") {
+		t.Fatalf("expected identifier to be derived from the selector's trailing name, got:\n%s", got)
+	}
+	if strings.Contains(got, "genTTime") || strings.Contains(got, "Time.Duration") {
+		t.Fatalf("qualified kind leaked into an identifier:\n%s", got)
+	}
+}
+
+func TestInstantiateMultiParamDisambiguatesAlias(t *testing.T) {
+	src := `package pair
+
+type genK interface{}
+type genV interface{}
+
+type AnyT struct {
+	key   genK
+	value genV
+}
+`
+	params := []TypeParam{{Name: "K", Kind: "int"}, {Name: "V", Kind: "int"}}
+	out, err := Instantiate("pair.go", []byte(src), params, TypeName("", params), "pair", nil)
+	if err != nil {
+		t.Fatalf("Instantiate: %v", err)
+	}
+
+	got := string(out)
+	if !strings.Contains(got, "genKInt") || !strings.Contains(got, "genVInt") {
+		t.Fatalf("expected disambiguated genKInt/genVInt aliases for a multi-parameter generic, got:\n%s", got)
+	}
+}
+
+func TestMatchTypeParamsMismatch(t *testing.T) {
+	err := MatchTypeParams([]string{"T"}, []TypeParam{{Name: "K", Kind: "int"}, {Name: "V", Kind: "int"}})
+	if err == nil {
+		t.Fatal("expected an error for a param count mismatch")
+	}
+}
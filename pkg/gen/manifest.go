@@ -0,0 +1,291 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+package gen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instance describes a single instantiation of a Generic: the type
+// parameters to substitute, the identifier and output file to give it, and
+// any packages its concrete types require.
+type Instance struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name,omitempty"`
+	Output  string   `json:"output,omitempty"`
+	Lib     bool     `json:"lib,omitempty"`
+	Imports []string `json:"imports,omitempty"`
+}
+
+// Generic describes a generic source, or a directory of them, and the
+// Instances to produce from each. Source names a single generic source
+// file; InputDirs instead names glob patterns (e.g. "collections/*.go")
+// whose matches are every one treated as a generic source sharing the same
+// Instances. Exactly one of Source or InputDirs should be set.
+type Generic struct {
+	Source    string     `json:"source,omitempty"`
+	InputDirs []string   `json:"inputDirs,omitempty"`
+	Instances []Instance `json:"instances"`
+}
+
+// Manifest describes a batch of golem instantiations to generate in one
+// pass, loaded from golem.json in the working directory. It lets a library
+// author publish one file that instantiates dozens of variants (e.g. a
+// stack, a queue, a heap) instead of a `//go:generate` line per variant.
+type Manifest struct {
+	GeneratedBuildTag string    `json:"generatedBuildTag,omitempty"`
+	Clean             bool      `json:"clean,omitempty"`
+	Generics          []Generic `json:"generics"`
+}
+
+// LoadManifest reads and parses a golem.json manifest.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Output is a single file produced by a Builder run.
+type Output struct {
+	Path string
+	Data []byte
+}
+
+// genericSource pairs a resolved generic source path with the instances to
+// apply to it.
+type genericSource struct {
+	path      string
+	instances []Instance
+}
+
+// resolve expands every Generic's Source/InputDirs into concrete generic
+// source paths, relative to baseDir.
+func (m *Manifest) resolve(baseDir string) ([]genericSource, error) {
+	var sources []genericSource
+	for _, g := range m.Generics {
+		switch {
+		case g.Source != "" && len(g.InputDirs) > 0:
+			return nil, fmt.Errorf("generic entry sets both source and inputDirs")
+		case g.Source != "":
+			sources = append(sources, genericSource{path: filepath.Join(baseDir, g.Source), instances: g.Instances})
+		case len(g.InputDirs) > 0:
+			for _, pattern := range g.InputDirs {
+				matches, err := filepath.Glob(filepath.Join(baseDir, pattern))
+				if err != nil {
+					return nil, fmt.Errorf("invalid inputDirs pattern %q: %w", pattern, err)
+				}
+				for _, match := range matches {
+					sources = append(sources, genericSource{path: match, instances: g.Instances})
+				}
+			}
+		default:
+			return nil, fmt.Errorf("generic entry requires source or inputDirs")
+		}
+	}
+	return sources, nil
+}
+
+// Builder runs a Manifest: it reads each generic source once and fans its
+// Instances out to Instantiate, writing each result to its own output file.
+type Builder struct {
+	// BaseDir resolves relative source and output paths; defaults to ".".
+	BaseDir string
+	// Package is the output package name, e.g. the importing package's own
+	// name as reported by `go/build`.
+	Package string
+}
+
+// Build generates every instance described by m and returns the rendered
+// outputs, parallelizing the per-instance substitution and formatting
+// across the generics in the manifest.
+func (b *Builder) Build(m *Manifest) ([]Output, error) {
+	baseDir := b.BaseDir
+	if baseDir == "" {
+		baseDir = "."
+	}
+
+	sources, err := m.resolve(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		outputs []Output
+		errs    []error
+	)
+
+	for _, src := range sources {
+		src := src
+		input, err := ioutil.ReadFile(src.path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, inst := range src.instances {
+			inst := inst
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				out, err := b.buildOne(m, src.path, input, inst)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s (%s): %w", src.path, inst.Type, err))
+					return
+				}
+				outputs = append(outputs, out)
+			}()
+		}
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return outputs, nil
+}
+
+func (b *Builder) buildOne(m *Manifest, source string, input []byte, inst Instance) (Output, error) {
+	params, err := ParseTypeParams(inst.Type)
+	if err != nil {
+		return Output{}, err
+	}
+	imports, err := ParseImports(strings.Join(inst.Imports, ","))
+	if err != nil {
+		return Output{}, err
+	}
+	typename := TypeName(inst.Name, params)
+
+	generic := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	filename := inst.Output
+	if filename == "" {
+		filename = fmt.Sprintf("%s.go", generic)
+		if inst.Lib {
+			filename = fmt.Sprintf("%s.go", strings.ToLower(typename))
+		}
+	}
+
+	generated, err := Instantiate(source, input, params, typename, b.Package, imports)
+	if err != nil {
+		return Output{}, err
+	}
+
+	header := Header(source, inst, m.GeneratedBuildTag)
+	return Output{
+		Path: filepath.Join(b.BaseDir, filename),
+		Data: append(header, generated...),
+	}, nil
+}
+
+// WriteAll writes every output to disk concurrently with mode 0777,
+// matching golem's single-shot mode, and returns the first error in
+// output order.
+func WriteAll(outputs []Output) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(outputs))
+	for i, out := range outputs {
+		wg.Add(1)
+		go func(i int, out Output) {
+			defer wg.Done()
+			errs[i] = ioutil.WriteFile(out.Path, out.Data, 0777)
+		}(i, out)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stamp is the header comment written to every generated file; Clean uses
+// it to recognize which instance of which source produced a file, so it
+// can tell a source being dropped from the manifest apart from just one of
+// its instances being dropped.
+func Stamp(source string, inst Instance) string {
+	return fmt.Sprintf("// Source: %s %s %s\n", source, inst.Type, inst.Name)
+}
+
+// Header renders the full comment block written atop a generated file,
+// including an optional `+build` tag.
+func Header(source string, inst Instance, buildTag string) []byte {
+	h := "// Code generated by `golem` package\n" + Stamp(source, inst) +
+		fmt.Sprintf("// Time: %s\n", time.Now().UTC())
+	if buildTag != "" {
+		h = fmt.Sprintf("// +build %s\n\n", buildTag) + h
+	}
+	return []byte(h + "\n")
+}
+
+// Clean removes every *.go file directly under dir whose Stamp no longer
+// names one of the manifest's resolved generic source/instance pairs,
+// returning the paths it removed.
+func (b *Builder) Clean(m *Manifest, dir string) ([]string, error) {
+	sources, err := m.resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		for _, inst := range src.instances {
+			live[Stamp(src.path, inst)] = true
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, path := range matches {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(string(data), "// Code generated by `golem` package") {
+			continue
+		}
+		stamped := false
+		for stamp := range live {
+			if strings.Contains(string(data), stamp) {
+				stamped = true
+				break
+			}
+		}
+		if stamped {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
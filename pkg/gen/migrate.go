@@ -0,0 +1,305 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+package gen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// Migrate rewrites file in place from the legacy `genT interface{}`/`AnyT`
+// convention to native Go 1.18+ type parameters: every declared `gen<Name>`
+// becomes a `[Name any]` parameter on the type previously named `AnyT`, and
+// every `gen<Name>` reference becomes the bare parameter identifier. It
+// returns the migrated type's name, which is always `AnyT`; a source with
+// no `type AnyT ...` declaration is an error. It is the transform behind
+// both the `golem migrate` subcommand and `-emit generics`'s synthesized
+// `*_generic.go` file.
+func Migrate(file *ast.File) (string, error) {
+	vars := DeclaredTypeVars(file)
+	if len(vars) == 0 {
+		return "", fmt.Errorf("no `type gen<Name> interface{}` declaration found to migrate")
+	}
+
+	fields := &ast.FieldList{}
+	renames := make(map[string]string, len(vars))
+	for _, v := range vars {
+		removeTypeSpec(file, "gen"+v)
+		fields.List = append(fields.List, &ast.Field{
+			Names: []*ast.Ident{ast.NewIdent(v)},
+			Type:  ast.NewIdent("any"),
+		})
+		renames["gen"+v] = v
+	}
+	renameIdents(file, renames)
+	pruneEmptyDecls(file)
+
+	name, err := addTypeParams(file, "AnyT", fields)
+	if err != nil {
+		return "", err
+	}
+	addReceiverTypeParams(file, name, fields)
+	addFreeFuncTypeParams(file, name, fields)
+	return name, nil
+}
+
+// addReceiverTypeParams rewrites every method receiver of the form `(s
+// name)`/`(s *name)` to `(s name[T, ...])`/`(s *name[T, ...])`, naming the
+// type parameters declared in fields. Without this, a migrated type's
+// methods reference their own type parameters (e.g. `T` in `func (s *AnyT)
+// Push(x T)`) without ever binding them, which fails to compile.
+func addReceiverTypeParams(file *ast.File, name string, fields *ast.FieldList) {
+	indices := make([]ast.Expr, len(fields.List))
+	for i, f := range fields.List {
+		indices[i] = ast.NewIdent(f.Names[0].Name)
+	}
+
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 {
+			continue
+		}
+
+		recv := fn.Recv.List[0]
+		target := recv.Type
+		star, isPtr := target.(*ast.StarExpr)
+		if isPtr {
+			target = star.X
+		}
+		id, ok := target.(*ast.Ident)
+		if !ok || id.Name != name {
+			continue
+		}
+
+		var indexed ast.Expr
+		if len(indices) == 1 {
+			indexed = &ast.IndexExpr{X: id, Index: indices[0]}
+		} else {
+			indexed = &ast.IndexListExpr{X: id, Indices: indices}
+		}
+		if isPtr {
+			star.X = indexed
+		} else {
+			recv.Type = indexed
+		}
+	}
+}
+
+// addFreeFuncTypeParams binds the migrated type's parameters on every
+// top-level function (one with no receiver) that refers to them or to name
+// itself, e.g. a constructor `func NewAnyT(x T) AnyT { return AnyT{...} }`.
+// Without this, such a function references its own type parameter (`T`)
+// without ever declaring it, and a bare `AnyT` result/field type fails to
+// compile as an uninstantiated generic type. A bare reference to name is
+// rewritten to its instantiated form (e.g. `AnyT` -> `AnyT[T]`) in the
+// function's signature and in composite literals/var declarations in its
+// body; bare references to the parameter names themselves (e.g. `T`) need
+// no rewriting, only the new `[T any, ...]` on the function to declare them.
+func addFreeFuncTypeParams(file *ast.File, name string, fields *ast.FieldList) {
+	typeVars := make(map[string]bool, len(fields.List))
+	for _, f := range fields.List {
+		typeVars[f.Names[0].Name] = true
+	}
+
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+
+		references := false
+		ast.Inspect(fn, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && (id.Name == name || typeVars[id.Name]) {
+				references = true
+			}
+			return true
+		})
+		if !references {
+			continue
+		}
+
+		indexed := func() ast.Expr { return indexType(name, fields) }
+		for _, list := range []*ast.FieldList{fn.Type.Params, fn.Type.Results} {
+			if list == nil {
+				continue
+			}
+			for _, f := range list.List {
+				f.Type = rewriteBareType(f.Type, name, indexed)
+			}
+		}
+		if fn.Body != nil {
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				switch e := n.(type) {
+				case *ast.CompositeLit:
+					e.Type = rewriteBareType(e.Type, name, indexed)
+				case *ast.ValueSpec:
+					if e.Type != nil {
+						e.Type = rewriteBareType(e.Type, name, indexed)
+					}
+				}
+				return true
+			})
+		}
+
+		if fn.Type.TypeParams == nil {
+			fn.Type.TypeParams = cloneFieldList(fields)
+		}
+	}
+}
+
+// indexType renders `name[T, ...]`, naming the type parameters declared in
+// fields.
+func indexType(name string, fields *ast.FieldList) ast.Expr {
+	indices := make([]ast.Expr, len(fields.List))
+	for i, f := range fields.List {
+		indices[i] = ast.NewIdent(f.Names[0].Name)
+	}
+	if len(indices) == 1 {
+		return &ast.IndexExpr{X: ast.NewIdent(name), Index: indices[0]}
+	}
+	return &ast.IndexListExpr{X: ast.NewIdent(name), Indices: indices}
+}
+
+// rewriteBareType replaces a bare occurrence of name within a type
+// expression with indexed(), descending through the wrapper types a
+// migrated generic's type is commonly used inside (pointer, slice, map,
+// channel).
+func rewriteBareType(expr ast.Expr, name string, indexed func() ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if e.Name == name {
+			return indexed()
+		}
+		return expr
+	case *ast.StarExpr:
+		e.X = rewriteBareType(e.X, name, indexed)
+		return e
+	case *ast.ArrayType:
+		e.Elt = rewriteBareType(e.Elt, name, indexed)
+		return e
+	case *ast.MapType:
+		e.Key = rewriteBareType(e.Key, name, indexed)
+		e.Value = rewriteBareType(e.Value, name, indexed)
+		return e
+	case *ast.ChanType:
+		e.Value = rewriteBareType(e.Value, name, indexed)
+		return e
+	default:
+		return expr
+	}
+}
+
+// cloneFieldList copies fields into a fresh *ast.FieldList of `any`
+// constraints, so each function that binds the migrated type's parameters
+// gets its own AST nodes rather than sharing one across the file.
+func cloneFieldList(fields *ast.FieldList) *ast.FieldList {
+	clone := &ast.FieldList{}
+	for _, f := range fields.List {
+		clone.List = append(clone.List, &ast.Field{
+			Names: []*ast.Ident{ast.NewIdent(f.Names[0].Name)},
+			Type:  ast.NewIdent("any"),
+		})
+	}
+	return clone
+}
+
+// removeTypeSpec deletes every `type name ...` declaration from file.
+func removeTypeSpec(file *ast.File, name string) {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		specs := gen.Specs[:0]
+		for _, s := range gen.Specs {
+			if ts, ok := s.(*ast.TypeSpec); !ok || ts.Name.Name != name {
+				specs = append(specs, s)
+			}
+		}
+		gen.Specs = specs
+	}
+}
+
+// pruneEmptyDecls drops GenDecls left with no specs after removeTypeSpec.
+func pruneEmptyDecls(file *ast.File) {
+	decls := file.Decls[:0]
+	for _, d := range file.Decls {
+		if gen, ok := d.(*ast.GenDecl); ok && len(gen.Specs) == 0 {
+			continue
+		}
+		decls = append(decls, d)
+	}
+	file.Decls = decls
+}
+
+// addTypeParams attaches fields as the type parameter list of the type
+// declared as name, reporting an error if no such declaration exists.
+func addTypeParams(file *ast.File, name string, fields *ast.FieldList) (string, error) {
+	found := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != name {
+			return true
+		}
+		spec.TypeParams = fields
+		found = true
+		return false
+	})
+	if !found {
+		return "", fmt.Errorf("generic source has no `type %s ...` declaration to add type parameters to", name)
+	}
+	return name, nil
+}
+
+// GenericAlias renders a thin wrapper aliasing typename to a concrete
+// instantiation of a migrated generic, e.g. `type Int = Stack[int]`.
+func GenericAlias(pkg, genericName string, params []TypeParam, typename string) ([]byte, error) {
+	kinds := make([]string, len(params))
+	for i, p := range params {
+		kinds[i] = p.Kind
+	}
+	src := fmt.Sprintf("package %s\n\ntype %s = %s[%s]\n", pkg, typename, genericName, strings.Join(kinds, ", "))
+	return format.Source([]byte(src))
+}
+
+// EmitGenerics migrates src to native type parameters and renders the
+// alias wrapper for params/typename in one step; it is the engine behind
+// `-emit generics`. genericSrc is the generic as rewritten by Migrate, still
+// under its original package clause; aliasSrc is the `type <typename> = ...`
+// wrapper; genericName is the migrated type's own name.
+func EmitGenerics(filename string, src []byte, params []TypeParam, typename, pkg string) (genericSrc, aliasSrc []byte, genericName string, err error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := MatchTypeParams(DeclaredTypeVars(file), params); err != nil {
+		return nil, nil, "", err
+	}
+
+	genericName, err = Migrate(file)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	genericSrc, err = Print(fset, file)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	aliasSrc, err = GenericAlias(pkg, genericName, params, typename)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return genericSrc, aliasSrc, genericName, nil
+}
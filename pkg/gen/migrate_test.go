@@ -0,0 +1,69 @@
+//
+// Copyright (C) 2019 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/golem
+//
+
+package gen
+
+import (
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// migrateSrc mirrors a small real-world generic: a constructor (free
+// function) alongside a method, both referencing the type variable and the
+// generic type itself.
+const migrateSrc = `package stack
+
+type genT interface{}
+
+type AnyT struct {
+	elements []genT
+}
+
+func NewAnyT(x genT) AnyT { return AnyT{elements: []genT{x}} }
+
+func (s *AnyT) Push(x genT) { s.elements = append(s.elements, x) }
+`
+
+func TestMigrateBindsFreeFunctionTypeParams(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "stack.go", migrateSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+
+	name, err := Migrate(file)
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if name != "AnyT" {
+		t.Fatalf("migrated name = %q, want AnyT", name)
+	}
+
+	out, err := Print(fset, file)
+	if err != nil {
+		t.Fatalf("Print: %v", err)
+	}
+
+	if _, err := format.Source(out); err != nil {
+		t.Fatalf("migrated source is not valid Go: %v\n%s", err, out)
+	}
+
+	got := string(out)
+	if !strings.Contains(got, "func NewAnyT[T any](x T) AnyT[T]") {
+		t.Fatalf("expected NewAnyT to bind [T any] and instantiate its result type, got:\n%s", got)
+	}
+	if !strings.Contains(got, "AnyT[T]{elements: []T{x}}") {
+		t.Fatalf("expected the composite literal's bare AnyT to become AnyT[T], got:\n%s", got)
+	}
+	if !strings.Contains(got, "func (s *AnyT[T]) Push(x T)") {
+		t.Fatalf("expected the method receiver to bind [T], got:\n%s", got)
+	}
+}